@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"image"
@@ -16,7 +17,6 @@ import (
 	"time"
 
 	"github.com/chai2010/webp"
-	"github.com/google/uuid"
 )
 
 const (
@@ -30,15 +30,14 @@ const (
 	ConvertToWebP = true     // Enable/disable WebP conversion
 )
 
-// Statistics struct for better organization
+// Stats is the legacy summary shape returned by GET /stats, now populated
+// as a thin projection over the Prometheus counters in metrics.go.
 type Stats struct {
 	Uploads int `json:"uploads"`
 	Gets    int `json:"gets"`
 	Deletes int `json:"deletes"`
 }
 
-var stats Stats
-
 // Response structs for consistent JSON responses
 type UploadResponse struct {
 	URL         string `json:"url"`
@@ -46,6 +45,8 @@ type UploadResponse struct {
 	OriginalExt string `json:"original_extension,omitempty"`
 	Size        int64  `json:"size"`
 	Converted   bool   `json:"converted_to_webp"`
+	SHA256      string `json:"sha256"`
+	DeleteKey   string `json:"delete_key"`
 	Message     string `json:"message"`
 }
 
@@ -87,12 +88,37 @@ func main() {
 		log.Fatal("Failed to create upload directory:", err)
 	}
 
+	if err := ensureTusDir(); err != nil {
+		log.Fatal("Failed to create tus upload directory:", err)
+	}
+
+	if err := ensureTmpDir(); err != nil {
+		log.Fatal("Failed to create temp upload directory:", err)
+	}
+
+	if err := ensureMetaDir(); err != nil {
+		log.Fatal("Failed to create metadata directory:", err)
+	}
+	go expiryGC()
+
+	if err := ensureCacheDir(); err != nil {
+		log.Fatal("Failed to create image cache directory:", err)
+	}
+
+	b, err := newStorageBackend()
+	if err != nil {
+		log.Fatal("Failed to initialize storage backend:", err)
+	}
+	backend = b
+	fmt.Printf("Storage backend: %T\n", backend)
+	go startSearchIndexer()
+
 	fmt.Printf("Upload directory: %s\n", absUploadDir)
 	fmt.Printf("Max file size: %d MB\n", MaxFileSize/(1<<20))
 	fmt.Printf("Max memory for uploads: %d MB\n", MaxMemory/(1<<20))
 
 	// List existing files on startup
-	listExistingFiles(absUploadDir)
+	listExistingFiles()
 
 	// Create custom server with increased limits
 	server := &http.Server{
@@ -108,9 +134,13 @@ func main() {
 	http.HandleFunc("/upload", withAuth(handleUpload))
 	http.HandleFunc("/uploads/", handleServeFile)
 	http.HandleFunc("/get/", handleServeFile) // Alternative endpoint
-	http.HandleFunc("/files", handleFileList)
-	http.HandleFunc("/delete/", withAuth(handleDelete))
+	http.HandleFunc("/files", handleTusOrList)
+	http.HandleFunc("/files/", handleTusFiles)
+	http.HandleFunc("/archive/", handleArchive)
+	http.HandleFunc("/search", handleSearch)
+	http.HandleFunc("/delete/", handleDelete)
 	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/metrics", handleMetrics)
 	http.HandleFunc("/health", handleHealth)
 
 	fmt.Printf("S3 Clone Server starting at %s\n", BaseURL)
@@ -122,15 +152,22 @@ func main() {
 	}
 	fmt.Println("Download endpoint: GET /uploads/<filename>")
 	fmt.Println("List files: GET /files")
-	fmt.Println("Delete file: DELETE /delete/<filename> (requires auth)")
+	fmt.Println("Resumable uploads (tus.io): POST /files, HEAD/PATCH /files/<id>")
+	fmt.Println("Delete file: DELETE /delete/<filename> (requires auth or delete_key)")
+	fmt.Println("Expiring uploads: set Upload-Expiry header (relative seconds or absolute Unix time)")
+	fmt.Println("Bulk archive download: GET /archive/<name>.zip|.tar.gz?files=a,b,c")
+	fmt.Println("Storage backend: set STORAGE_BACKEND=local (default) or s3 (S3_BUCKET, S3_REGION, S3_ENDPOINT)")
+	fmt.Println("Image variants: GET /uploads/<file>?w=800&h=600&fit=cover&fmt=webp&q=75&blur=3")
+	fmt.Println("Search: GET /search?q=foo&ext=jpg&min_size=1024&max_size=&modified_after=")
 	fmt.Println("Statistics: GET /stats")
+	fmt.Println("Prometheus metrics: GET /metrics")
 	fmt.Println("Health check: GET /health")
 
 	log.Fatal(server.ListenAndServe())
 }
 
-func listExistingFiles(dir string) {
-	files, err := os.ReadDir(dir)
+func listExistingFiles() {
+	files, err := backend.List()
 	if err != nil {
 		fmt.Printf("Warning: Could not read upload directory: %v\n", err)
 		return
@@ -143,31 +180,37 @@ func listExistingFiles(dir string) {
 
 	fmt.Printf("Found %d existing files:\n", len(files))
 	for _, file := range files {
-		if !file.IsDir() {
-			info, _ := file.Info()
-			fmt.Printf("   - %s (%d bytes)\n", file.Name(), info.Size())
-		}
+		fmt.Printf("   - %s (%d bytes)\n", file.Name, file.Size)
 	}
 }
 
-// Middleware for logging requests
+// Middleware for logging requests, and for recording lfs_request_duration_seconds.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		observeRequestDuration(routeLabel(r.URL.Path), r.Method, duration.Seconds())
+
 		fmt.Printf("[%s] %s %s - %v\n",
 			start.Format("15:04:05"),
 			r.Method,
 			r.URL.Path,
-			time.Since(start))
+			duration)
 	})
 }
 
+// isAuthorized reports whether the request carries the expected bearer token.
+func isAuthorized(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "Bearer "+AuthToken
+}
+
 // Authentication middleware
 func withAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if auth != "Bearer "+AuthToken {
+		if !isAuthorized(r) {
 			sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized, "Invalid or missing authorization token")
 			return
 		}
@@ -188,10 +231,16 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 		"version": "1.0.0",
 		"endpoints": map[string]string{
 			"POST /upload":          "Upload a file (requires Bearer token)",
-			"GET /uploads/<file>":   "Download a file",
+			"GET /uploads/<file>":   "Download a file, or a resized/re-encoded variant via ?w=&h=&fit=&fmt=&q=&blur=",
 			"GET /files":            "List all files",
-			"DELETE /delete/<file>": "Delete a file (requires Bearer token)",
+			"POST /files":           "Create a resumable upload (tus.io, requires Bearer token)",
+			"HEAD /files/<id>":      "Get resumable upload offset",
+			"PATCH /files/<id>":     "Append a chunk to a resumable upload (requires Bearer token)",
+			"DELETE /delete/<file>": "Delete a file (requires Bearer token or its delete_key)",
+			"GET /archive/<name>":   "Download multiple files as <name>.zip or <name>.tar.gz (?files=a,b,c)",
+			"GET /search":           "Search filenames and content (?q=&ext=&min_size=&max_size=&modified_after=)",
 			"GET /stats":            "Get server statistics",
+			"GET /metrics":          "Prometheus metrics",
 			"GET /health":           "Health check",
 		},
 		"auth_header": "Authorization: Bearer " + AuthToken,
@@ -222,126 +271,42 @@ func handleServeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(UploadDir, filename)
-
-	// Check if file exists and get info
-	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
+	if meta, err := readMetadata(filename); err == nil && meta.isExpired() {
+		backend.Delete(filename)
+		deleteMetadata(filename)
+		recordDownload(http.StatusNotFound, 0)
 		sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", filename))
 		return
 	}
-	if err != nil {
-		sendErrorResponse(w, "File access error", http.StatusInternalServerError, "Could not access file")
-		return
-	}
-
-	// Set appropriate headers
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
-	w.Header().Set("Last-Modified", fileInfo.ModTime().UTC().Format(http.TimeFormat))
-
-	// Serve the file
-	http.ServeFile(w, r, filePath)
 
-	stats.Gets++
-	fmt.Printf("Served file: %s (%d bytes)\n", filename, fileInfo.Size())
-}
-
-// Handle file uploads
-func handleUpload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use POST method")
+	if isTransformRequest(r.URL.Query()) {
+		handleImageVariant(w, r, filename)
 		return
 	}
 
-	// Set a reasonable content length limit (with overhead for multipart)
-	maxRequestSize := MaxFileSize + (10 << 20) // Add 10MB for multipart form overhead
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxRequestSize))
-
-	// Parse multipart form with increased memory limit
-	if err := r.ParseMultipartForm(MaxMemory); err != nil {
-		// Check if it's a size limit error
-		errStr := err.Error()
-		if strings.Contains(errStr, "too large") ||
-			strings.Contains(errStr, "multipart: message too large") ||
-			strings.Contains(errStr, "http: request body too large") {
-			sendErrorResponse(w, "File too large", http.StatusRequestEntityTooLarge,
-				fmt.Sprintf("Request size exceeds limit. Max file size: %d MB", MaxFileSize/(1<<20)))
-		} else {
-			sendErrorResponse(w, "Invalid form", http.StatusBadRequest, "Form data invalid: "+errStr)
-		}
+	reader, info, err := backend.Get(filename)
+	if os.IsNotExist(err) {
+		recordDownload(http.StatusNotFound, 0)
+		sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", filename))
 		return
 	}
-
-	file, handler, err := r.FormFile("file")
 	if err != nil {
-		sendErrorResponse(w, "No file provided", http.StatusBadRequest, "No file found in form data")
-		return
-	}
-	defer file.Close()
-
-	// Additional file size validation
-	if handler.Size > MaxFileSize {
-		sendErrorResponse(w, "File too large", http.StatusRequestEntityTooLarge,
-			fmt.Sprintf("File size (%d bytes = %.2f MB) exceeds %d MB limit",
-				handler.Size, float64(handler.Size)/(1<<20), MaxFileSize/(1<<20)))
-		return
-	}
-
-	// Generate unique filename
-	originalExt := strings.ToLower(filepath.Ext(handler.Filename))
-	id := uuid.New().String()
-
-	var filename string
-	var converted bool
-	var finalSize int64
-
-	// Check if file should be converted to WebP
-	if ConvertToWebP && isImageFile(originalExt) {
-		webpFilename := id + ".webp"
-		webpPath := filepath.Join(UploadDir, webpFilename)
-
-		convertedSize, err := convertToWebP(file, webpPath, originalExt)
-		if err != nil {
-			fmt.Printf("WebP conversion failed for %s: %v, saving original\n", handler.Filename, err)
-			// Fall back to saving original file
-			filename = id + originalExt
-			finalSize = saveOriginalFile(file, filepath.Join(UploadDir, filename))
-		} else {
-			filename = webpFilename
-			finalSize = convertedSize
-			converted = true
-		}
-	} else {
-		// Save original file
-		filename = id + originalExt
-		finalSize = saveOriginalFile(file, filepath.Join(UploadDir, filename))
-	}
-
-	if finalSize == 0 {
-		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not save file")
+		recordDownload(http.StatusInternalServerError, 0)
+		sendErrorResponse(w, "File access error", http.StatusInternalServerError, "Could not access file")
 		return
 	}
+	defer reader.Close()
 
-	url := fmt.Sprintf("%s/uploads/%s", BaseURL, filename)
-	response := UploadResponse{
-		URL:         url,
-		Filename:    filename,
-		OriginalExt: originalExt,
-		Size:        finalSize,
-		Converted:   converted,
-		Message:     "File uploaded successfully",
+	// Set appropriate headers
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	io.Copy(w, reader)
 
-	stats.Uploads++
-	if converted {
-		fmt.Printf("Uploaded & converted: %s -> %s (%d bytes, WebP)\n", handler.Filename, filename, finalSize)
-	} else {
-		fmt.Printf("Uploaded: %s -> %s (%d bytes)\n", handler.Filename, filename, finalSize)
-	}
+	recordDownload(http.StatusOK, info.Size)
+	fmt.Printf("Served file: %s (%d bytes)\n", filename, info.Size)
 }
 
 // Handle file listing
@@ -351,7 +316,7 @@ func handleFileList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files, err := os.ReadDir(UploadDir)
+	files, err := backend.List()
 	if err != nil {
 		sendErrorResponse(w, "Directory read failed", http.StatusInternalServerError, "Could not read upload directory")
 		return
@@ -359,20 +324,12 @@ func handleFileList(w http.ResponseWriter, r *http.Request) {
 
 	var fileList []FileInfo
 	for _, file := range files {
-		if !file.IsDir() {
-			info, err := file.Info()
-			if err != nil {
-				continue // Skip files with errors
-			}
-
-			fileInfo := FileInfo{
-				Name:     file.Name(),
-				Size:     info.Size(),
-				Modified: info.ModTime(),
-				URL:      fmt.Sprintf("%s/uploads/%s", BaseURL, file.Name()),
-			}
-			fileList = append(fileList, fileInfo)
-		}
+		fileList = append(fileList, FileInfo{
+			Name:     file.Name,
+			Size:     file.Size,
+			Modified: file.ModTime,
+			URL:      fmt.Sprintf("%s/uploads/%s", BaseURL, file.Name),
+		})
 	}
 
 	response := FileListResponse{
@@ -399,21 +356,33 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(UploadDir, filename)
-
-	// Check if file exists
-	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", filename))
+	if !isAuthorized(r) && !hasMatchingDeleteKey(r, filename) {
+		recordDelete(http.StatusUnauthorized)
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized, "Invalid or missing authorization token or delete key")
 		return
 	}
+
+	exists, err := backend.Exists(filename)
 	if err != nil {
+		recordDelete(http.StatusInternalServerError)
 		sendErrorResponse(w, "File access error", http.StatusInternalServerError, "Could not access file")
 		return
 	}
+	if !exists {
+		recordDelete(http.StatusNotFound)
+		sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", filename))
+		return
+	}
+
+	var size int64
+	if reader, info, err := backend.Get(filename); err == nil {
+		reader.Close()
+		size = info.Size
+	}
 
 	// Delete the file
-	if err := os.Remove(filePath); err != nil {
+	if err := backend.Delete(filename); err != nil {
+		recordDelete(http.StatusInternalServerError)
 		sendErrorResponse(w, "Delete failed", http.StatusInternalServerError, "Could not delete file")
 		return
 	}
@@ -421,14 +390,31 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"message":  "File deleted successfully",
 		"filename": filename,
-		"size":     fileInfo.Size(),
+		"size":     size,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 
-	stats.Deletes++
-	fmt.Printf("Deleted: %s (%d bytes)\n", filename, fileInfo.Size())
+	deleteMetadata(filename)
+
+	recordDelete(http.StatusOK)
+	fmt.Printf("Deleted: %s (%d bytes)\n", filename, size)
+}
+
+// hasMatchingDeleteKey reports whether the request supplies the delete key
+// that was issued for filename at upload time, via either the
+// X-Delete-Key header or a delete_key query parameter.
+func hasMatchingDeleteKey(r *http.Request, filename string) bool {
+	meta, err := readMetadata(filename)
+	if err != nil || meta.DeleteKey == "" {
+		return false
+	}
+	key := r.Header.Get("X-Delete-Key")
+	if key == "" {
+		key = r.URL.Query().Get("delete_key")
+	}
+	return key != "" && key == meta.DeleteKey
 }
 
 // Handle statistics
@@ -440,8 +426,12 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 
 	uptime := time.Since(startTime).Round(time.Second)
 	response := StatsResponse{
-		Statistics: stats,
-		Uptime:     uptime.String(),
+		Statistics: Stats{
+			Uploads: int(uploadsByStatus.total()),
+			Gets:    int(downloadsByStatus.total()),
+			Deletes: int(deletesByStatus.total()),
+		},
+		Uptime: uptime.String(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -496,8 +486,9 @@ func isImageFile(ext string) bool {
 	}
 }
 
-// Convert image to WebP format
-func convertToWebP(src io.Reader, outputPath string, originalExt string) (int64, error) {
+// Convert image to WebP format, writing the encoded bytes to dst so callers
+// can route them through any StorageBackend.
+func convertToWebP(src io.Reader, dst io.Writer, originalExt string) (int64, error) {
 	// Reset file pointer if it's a file
 	if seeker, ok := src.(io.Seeker); ok {
 		seeker.Seek(0, 0)
@@ -522,53 +513,21 @@ func convertToWebP(src io.Reader, outputPath string, originalExt string) (int64,
 		return 0, fmt.Errorf("failed to decode image: %w", err)
 	}
 
-	// Create output file
-	dst, err := os.Create(outputPath)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer dst.Close()
-
-	// Encode as WebP
+	// Encode as WebP into a buffer first so we know the final size
+	var buf bytes.Buffer
 	options := &webp.Options{
 		Lossless: false,
 		Quality:  WebPQuality,
 	}
 
-	if err := webp.Encode(dst, img, options); err != nil {
-		os.Remove(outputPath) // Clean up on error
+	if err := webp.Encode(&buf, img, options); err != nil {
 		return 0, fmt.Errorf("failed to encode WebP: %w", err)
 	}
+	size := int64(buf.Len())
 
-	// Get file size
-	fileInfo, err := dst.Stat()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get file info: %w", err)
-	}
-
-	return fileInfo.Size(), nil
-}
-
-// Save original file without conversion
-func saveOriginalFile(src io.Reader, outputPath string) int64 {
-	// Reset file pointer if it's a file
-	if seeker, ok := src.(io.Seeker); ok {
-		seeker.Seek(0, 0)
-	}
-
-	dst, err := os.Create(outputPath)
-	if err != nil {
-		fmt.Printf("Error creating file: %v\n", err)
-		return 0
-	}
-	defer dst.Close()
-
-	written, err := io.Copy(dst, src)
-	if err != nil {
-		os.Remove(outputPath) // Clean up on error
-		fmt.Printf("Error copying file: %v\n", err)
-		return 0
+	if _, err := io.Copy(dst, &buf); err != nil {
+		return 0, fmt.Errorf("failed to write WebP output: %w", err)
 	}
 
-	return written
+	return size, nil
 }
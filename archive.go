@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Handle bulk archive downloads: GET /archive/{name}.zip?files=a,b,c and the
+// .tar.gz equivalent, streaming the archive straight to the response
+// without staging it on disk first.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use GET method")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/archive/")
+
+	filesParam := r.URL.Query().Get("files")
+	if filesParam == "" {
+		sendErrorResponse(w, "No files specified", http.StatusBadRequest, "Provide a files=a,b,c query parameter")
+		return
+	}
+
+	requested := strings.Split(filesParam, ",")
+	filenames := make([]string, 0, len(requested))
+	for _, f := range requested {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if strings.Contains(f, "..") || strings.Contains(f, "/") {
+			sendErrorResponse(w, "Invalid filename", http.StatusBadRequest, fmt.Sprintf("Filename '%s' contains invalid characters", f))
+			return
+		}
+		if meta, err := readMetadata(f); err == nil && meta.isExpired() {
+			backend.Delete(f)
+			deleteMetadata(f)
+			sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", f))
+			return
+		}
+		exists, err := backend.Exists(f)
+		if err != nil || !exists {
+			sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", f))
+			return
+		}
+		filenames = append(filenames, f)
+	}
+	if len(filenames) == 0 {
+		sendErrorResponse(w, "No files specified", http.StatusBadRequest, "Provide a files=a,b,c query parameter")
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		w.Header().Set("Content-Type", "application/x-gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if err := writeTarGzArchive(w, filenames); err != nil {
+			fmt.Printf("Archive stream error: %v\n", err)
+		}
+	case strings.HasSuffix(name, ".zip"):
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if err := writeZipArchive(w, filenames); err != nil {
+			fmt.Printf("Archive stream error: %v\n", err)
+		}
+	default:
+		sendErrorResponse(w, "Unsupported archive type", http.StatusBadRequest, "Archive name must end in .zip or .tar.gz")
+		return
+	}
+
+	fmt.Printf("Archived %d files as %s\n", len(filenames), name)
+}
+
+func writeZipArchive(w io.Writer, filenames []string) error {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for _, filename := range filenames {
+		if err := addFileToZip(zw, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToZip(zw *zip.Writer, filename string) error {
+	src, info, err := backend.Get(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := &zip.FileHeader{
+		Name:     filename,
+		Method:   zip.Deflate,
+		Modified: info.ModTime,
+	}
+	header.SetMode(0644)
+
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, src)
+	return err
+}
+
+func writeTarGzArchive(w io.Writer, filenames []string) error {
+	gzw := gzip.NewWriter(w)
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	for _, filename := range filenames {
+		if err := addFileToTar(tw, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToTar(tw *tar.Writer, filename string) error {
+	src, info, err := backend.Get(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	header := &tar.Header{
+		Name:    filename,
+		Size:    info.Size,
+		Mode:    0644,
+		ModTime: info.ModTime,
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, src)
+	return err
+}
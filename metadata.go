@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MetaDir holds per-file metadata sidecars, mirroring the linx-server
+// approach of keeping upload bookkeeping separate from the served files.
+var MetaDir = filepath.Join(UploadDir, "meta")
+
+// FileMetadata is the sidecar written alongside every upload.
+type FileMetadata struct {
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"original_filename"`
+	DeleteKey        string `json:"delete_key"`
+	SHA256Sum        string `json:"sha256sum"`
+	Mimetype         string `json:"mimetype"`
+	Size             int64  `json:"size"`
+	ExpiryUnix       int64  `json:"expiry_unix,omitempty"`
+}
+
+func ensureMetaDir() error {
+	return os.MkdirAll(MetaDir, 0755)
+}
+
+func metaPath(filename string) string {
+	return filepath.Join(MetaDir, filename+".json")
+}
+
+func writeMetadata(meta *FileMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath(meta.Filename), data, 0644)
+}
+
+func readMetadata(filename string) (*FileMetadata, error) {
+	data, err := os.ReadFile(metaPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	var meta FileMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func deleteMetadata(filename string) error {
+	err := os.Remove(metaPath(filename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isExpired reports whether the metadata's expiry has passed. A zero
+// ExpiryUnix means the file never expires.
+func (m *FileMetadata) isExpired() bool {
+	return m.ExpiryUnix != 0 && time.Now().Unix() >= m.ExpiryUnix
+}
+
+// generateDeleteKey returns a random token an anonymous uploader can later
+// present to delete their own file.
+func generateDeleteKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseExpiryHeader interprets the Upload-Expiry header, accepting either a
+// relative number of seconds from now or an absolute Unix timestamp.
+func parseExpiryHeader(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid Upload-Expiry value: %s", value)
+	}
+	// Treat anything below 1<<30 (January 2004 as a Unix timestamp) as a
+	// relative duration; anything at or above it as an absolute Unix timestamp.
+	const absoluteThreshold = 1 << 30
+	if n < absoluteThreshold {
+		return time.Now().Unix() + n, nil
+	}
+	return n, nil
+}
+
+// mimeTypeForExt maps a file extension to a MIME type, special-casing the
+// formats this server itself produces before falling back to the system
+// mime.types database.
+func mimeTypeForExt(ext string) string {
+	switch ext {
+	case ".webp":
+		return "image/webp"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// expiryGC periodically scans metadata for expired files and removes both
+// the file and its sidecar.
+func expiryGC() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepExpiredFiles()
+	}
+}
+
+func sweepExpiredFiles() {
+	entries, err := os.ReadDir(MetaDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filename := entry.Name()[:len(entry.Name())-len(filepath.Ext(entry.Name()))]
+		meta, err := readMetadata(filename)
+		if err != nil || !meta.isExpired() {
+			continue
+		}
+		backend.Delete(filename)
+		deleteMetadata(filename)
+		fmt.Printf("Expired and removed: %s\n", filename)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the histogram bucket boundaries (seconds) used for
+// lfs_request_duration_seconds.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// webpSavingsBuckets are the histogram bucket boundaries (bytes) used for
+// lfs_webp_conversion_savings_bytes.
+var webpSavingsBuckets = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20}
+
+// statusCounter is a counter broken down by HTTP status code, the shape
+// Prometheus calls a counter vector.
+type statusCounter struct {
+	mu     sync.Mutex
+	counts map[int]int64
+}
+
+func newStatusCounter() *statusCounter {
+	return &statusCounter{counts: make(map[int]int64)}
+}
+
+func (c *statusCounter) inc(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[status]++
+}
+
+func (c *statusCounter) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum int64
+	for _, v := range c.counts {
+		sum += v
+	}
+	return sum
+}
+
+func (c *statusCounter) writeTo(w io.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]int, 0, len(c.counts))
+	for status := range c.counts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s{status=\"%d\"} %d\n", name, status, c.counts[status])
+	}
+}
+
+// histogram is a minimal Prometheus-style histogram: bucket counts are
+// cumulative, matching the "le" semantics of the exposition format.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	h.count++
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+func (h *histogram) writeTo(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatBound(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	if labels == "" {
+		fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+		fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	} else {
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func formatBound(v float64) string {
+	return strings.TrimRight(strings.TrimRight(fmt.Sprintf("%f", v), "0"), ".")
+}
+
+// Metrics tracked across the process lifetime. These back both the
+// Prometheus /metrics endpoint and the legacy JSON /stats endpoint.
+var (
+	uploadsByStatus   = newStatusCounter()
+	downloadsByStatus = newStatusCounter()
+	deletesByStatus   = newStatusCounter()
+
+	uploadBytesTotal   int64 // atomic
+	downloadBytesTotal int64 // atomic
+
+	webpSavingsHist = newHistogram(webpSavingsBuckets)
+
+	requestDurationsMu sync.Mutex
+	requestDurations   = make(map[string]*histogram) // "route|method" -> histogram
+)
+
+func recordUpload(status int, bytes int64) {
+	uploadsByStatus.inc(status)
+	atomic.AddInt64(&uploadBytesTotal, bytes)
+}
+
+func recordDownload(status int, bytes int64) {
+	downloadsByStatus.inc(status)
+	atomic.AddInt64(&downloadBytesTotal, bytes)
+}
+
+func recordDelete(status int) {
+	deletesByStatus.inc(status)
+}
+
+// recordWebPConversion observes the bytes saved by converting an image to
+// WebP; conversions that grow the file are not counted as savings.
+func recordWebPConversion(originalSize, convertedSize int64) {
+	if originalSize > convertedSize {
+		webpSavingsHist.observe(float64(originalSize - convertedSize))
+	}
+}
+
+// observeRequestDuration records how long a request to route (as returned
+// by routeLabel) took, broken down by HTTP method.
+func observeRequestDuration(route, method string, seconds float64) {
+	key := route + "|" + method
+
+	requestDurationsMu.Lock()
+	h, ok := requestDurations[key]
+	if !ok {
+		h = newHistogram(durationBuckets)
+		requestDurations[key] = h
+	}
+	requestDurationsMu.Unlock()
+
+	h.observe(seconds)
+}
+
+// routeLabel collapses a request path into a low-cardinality route label by
+// replacing path segments that carry dynamic ids/filenames with a placeholder.
+func routeLabel(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/uploads/"):
+		return "/uploads/:file"
+	case strings.HasPrefix(path, "/get/"):
+		return "/get/:file"
+	case strings.HasPrefix(path, "/files/"):
+		return "/files/:id"
+	case strings.HasPrefix(path, "/delete/"):
+		return "/delete/:file"
+	case strings.HasPrefix(path, "/archive/"):
+		return "/archive/:name"
+	default:
+		return path
+	}
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code
+// written by the handler, for use by loggingMiddleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Handle GET /metrics in Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use GET method")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP lfs_uploads_total Total number of upload requests, by response status code.")
+	fmt.Fprintln(w, "# TYPE lfs_uploads_total counter")
+	uploadsByStatus.writeTo(w, "lfs_uploads_total")
+
+	fmt.Fprintln(w, "# HELP lfs_downloads_total Total number of download requests, by response status code.")
+	fmt.Fprintln(w, "# TYPE lfs_downloads_total counter")
+	downloadsByStatus.writeTo(w, "lfs_downloads_total")
+
+	fmt.Fprintln(w, "# HELP lfs_deletes_total Total number of delete requests, by response status code.")
+	fmt.Fprintln(w, "# TYPE lfs_deletes_total counter")
+	deletesByStatus.writeTo(w, "lfs_deletes_total")
+
+	fmt.Fprintln(w, "# HELP lfs_upload_bytes_total Total bytes stored by successful uploads, after any WebP conversion.")
+	fmt.Fprintln(w, "# TYPE lfs_upload_bytes_total counter")
+	fmt.Fprintf(w, "lfs_upload_bytes_total %d\n", atomic.LoadInt64(&uploadBytesTotal))
+
+	fmt.Fprintln(w, "# HELP lfs_download_bytes_total Total bytes served via downloads.")
+	fmt.Fprintln(w, "# TYPE lfs_download_bytes_total counter")
+	fmt.Fprintf(w, "lfs_download_bytes_total %d\n", atomic.LoadInt64(&downloadBytesTotal))
+
+	fmt.Fprintln(w, "# HELP lfs_request_duration_seconds Request duration in seconds, by route and method.")
+	fmt.Fprintln(w, "# TYPE lfs_request_duration_seconds histogram")
+	requestDurationsMu.Lock()
+	keys := make([]string, 0, len(requestDurations))
+	for key := range requestDurations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := requestDurations[key]
+		parts := strings.SplitN(key, "|", 2)
+		labels := fmt.Sprintf("route=%q,method=%q", parts[0], parts[1])
+		h.writeTo(w, "lfs_request_duration_seconds", labels)
+	}
+	requestDurationsMu.Unlock()
+
+	filesCurrent, bytesCurrent := currentFileStats()
+
+	fmt.Fprintln(w, "# HELP lfs_files_current Current number of stored files.")
+	fmt.Fprintln(w, "# TYPE lfs_files_current gauge")
+	fmt.Fprintf(w, "lfs_files_current %d\n", filesCurrent)
+
+	fmt.Fprintln(w, "# HELP lfs_bytes_current Current total bytes of stored files.")
+	fmt.Fprintln(w, "# TYPE lfs_bytes_current gauge")
+	fmt.Fprintf(w, "lfs_bytes_current %d\n", bytesCurrent)
+
+	fmt.Fprintln(w, "# HELP lfs_webp_conversion_savings_bytes Bytes saved per file converted to WebP (original size minus converted size).")
+	fmt.Fprintln(w, "# TYPE lfs_webp_conversion_savings_bytes histogram")
+	webpSavingsHist.writeTo(w, "lfs_webp_conversion_savings_bytes", "")
+
+	fmt.Fprintln(w, "# HELP lfs_uptime_seconds Seconds since the server started.")
+	fmt.Fprintln(w, "# TYPE lfs_uptime_seconds gauge")
+	fmt.Fprintf(w, "lfs_uptime_seconds %g\n", time.Since(startTime).Seconds())
+}
+
+// currentFileStats recomputes the file count and total size from the active
+// StorageBackend on every scrape, so the gauges never drift from storage.
+func currentFileStats() (files int64, bytes int64) {
+	entries, err := backend.List()
+	if err != nil {
+		return 0, 0
+	}
+	for _, entry := range entries {
+		files++
+		bytes += entry.Size
+	}
+	return files, bytes
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	searchRebuildInterval = 10 * time.Minute
+	searchPerFileSample   = 64 << 10 // sample up to 64 KB of content per file
+	searchMaxIndexedBytes = 16 << 20 // cap total indexed content to avoid unbounded memory
+)
+
+// IndexFileItem is one entry in the in-memory search index, mirroring
+// gohttpserver's makeIndex approach.
+type IndexFileItem struct {
+	Path string
+	Info StorageFileInfo
+}
+
+var (
+	searchMu     sync.RWMutex
+	searchIndex  []IndexFileItem
+	contentIndex map[string][]int // token -> indices into searchIndex
+)
+
+// startSearchIndexer builds the index immediately, then rebuilds it every
+// searchRebuildInterval.
+func startSearchIndexer() {
+	rebuildSearchIndex()
+	ticker := time.NewTicker(searchRebuildInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rebuildSearchIndex()
+	}
+}
+
+func rebuildSearchIndex() {
+	files, err := backend.List()
+	if err != nil {
+		fmt.Printf("Search index rebuild failed: %v\n", err)
+		return
+	}
+
+	items := make([]IndexFileItem, 0, len(files))
+	tokens := make(map[string][]int)
+	var indexedBytes int64
+
+	for i, f := range files {
+		items = append(items, IndexFileItem{Path: f.Name, Info: f})
+
+		if indexedBytes >= searchMaxIndexedBytes || !isTextLikeExt(filepath.Ext(f.Name)) {
+			continue
+		}
+		content, n, err := sampleFileContent(f.Name, searchPerFileSample)
+		if err != nil {
+			continue
+		}
+		indexedBytes += n
+		for _, tok := range tokenize(content) {
+			tokens[tok] = append(tokens[tok], i)
+		}
+	}
+
+	searchMu.Lock()
+	searchIndex = items
+	contentIndex = tokens
+	searchMu.Unlock()
+
+	fmt.Printf("Search index rebuilt: %d files, %d bytes of content indexed\n", len(items), indexedBytes)
+}
+
+func isTextLikeExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".txt", ".md", ".json", ".csv", ".log":
+		return true
+	default:
+		return false
+	}
+}
+
+func sampleFileContent(filename string, limit int64) (string, int64, error) {
+	reader, _, err := backend.Get(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, limit))
+	if err != nil {
+		return "", 0, err
+	}
+	return string(data), int64(len(data)), nil
+}
+
+func tokenize(content string) []string {
+	return strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+}
+
+// fuzzyScore reports a fzf-style match score for query against name: exact
+// substrings score highest, and a subsequence match earns a bonus for each
+// run of consecutive matching characters.
+func fuzzyScore(name, query string) (int, bool) {
+	if query == "" {
+		return 0, true
+	}
+	if strings.Contains(name, query) {
+		return 1000 + len(query)*2, true
+	}
+
+	qi, score, run := 0, 0, 0
+	for i := 0; i < len(name) && qi < len(query); i++ {
+		if name[i] == query[qi] {
+			run++
+			score += run
+			qi++
+		} else {
+			run = 0
+		}
+	}
+	if qi == len(query) {
+		return score, true
+	}
+	return 0, false
+}
+
+type searchResult struct {
+	item  IndexFileItem
+	score int
+}
+
+// Handle GET /search?q=...&ext=jpg&min_size=1024&max_size=...&modified_after=...
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use GET method")
+		return
+	}
+
+	q := r.URL.Query()
+	query := strings.ToLower(strings.TrimSpace(q.Get("q")))
+	extFilter := strings.ToLower(strings.TrimPrefix(q.Get("ext"), "."))
+
+	minSize, err := parseOptionalInt64(q.Get("min_size"))
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "min_size must be an integer")
+		return
+	}
+	maxSize, err := parseOptionalInt64(q.Get("max_size"))
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "max_size must be an integer")
+		return
+	}
+	modifiedAfter, err := parseOptionalInt64(q.Get("modified_after"))
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "modified_after must be a Unix timestamp")
+		return
+	}
+
+	queryTokens := tokenize(query)
+
+	searchMu.RLock()
+	results := make([]searchResult, 0, len(searchIndex))
+	for i, item := range searchIndex {
+		if extFilter != "" && !strings.EqualFold(strings.TrimPrefix(filepath.Ext(item.Path), "."), extFilter) {
+			continue
+		}
+		if minSize > 0 && item.Info.Size < minSize {
+			continue
+		}
+		if maxSize > 0 && item.Info.Size > maxSize {
+			continue
+		}
+		if modifiedAfter > 0 && item.Info.ModTime.Unix() < modifiedAfter {
+			continue
+		}
+
+		if query == "" {
+			results = append(results, searchResult{item: item, score: 0})
+			continue
+		}
+
+		score, matched := fuzzyScore(strings.ToLower(item.Path), query)
+		for _, tok := range queryTokens {
+			for _, idx := range contentIndex[tok] {
+				if idx == i {
+					score += 50
+					matched = true
+				}
+			}
+		}
+		if matched {
+			results = append(results, searchResult{item: item, score: score})
+		}
+	}
+	searchMu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].item.Info.ModTime.After(results[j].item.Info.ModTime)
+	})
+
+	fileList := make([]FileInfo, 0, len(results))
+	for _, res := range results {
+		fileList = append(fileList, FileInfo{
+			Name:     res.item.Path,
+			Size:     res.item.Info.Size,
+			Modified: res.item.Info.ModTime,
+			URL:      fmt.Sprintf("%s/uploads/%s", BaseURL, res.item.Path),
+		})
+	}
+
+	response := FileListResponse{
+		Files: fileList,
+		Count: len(fileList),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func parseOptionalInt64(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// StorageFileInfo is the backend-agnostic shape returned for a stored
+// object; handlers decorate it with a serving URL as needed.
+type StorageFileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StorageBackend abstracts where uploaded bytes actually live, so the HTTP
+// handlers don't need to know whether a file sits on local disk or in an
+// S3-compatible bucket.
+type StorageBackend interface {
+	Put(key string, r io.Reader) (int64, error)
+	Get(key string) (io.ReadCloser, StorageFileInfo, error)
+	Delete(key string) error
+	List() ([]StorageFileInfo, error)
+	Exists(key string) (bool, error)
+}
+
+// backend is the process-wide storage backend, selected at startup by
+// newStorageBackend.
+var backend StorageBackend
+
+// newStorageBackend picks a StorageBackend based on the STORAGE_BACKEND
+// environment variable ("local", the default, or "s3").
+func newStorageBackend() (StorageBackend, error) {
+	switch strings.ToLower(os.Getenv("STORAGE_BACKEND")) {
+	case "s3":
+		return newS3Backend()
+	case "", "local", "localfs":
+		return &LocalFSBackend{Dir: UploadDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND: %s", os.Getenv("STORAGE_BACKEND"))
+	}
+}
+
+// LocalFSBackend stores files directly on local disk under Dir, preserving
+// the server's original on-disk behavior.
+type LocalFSBackend struct {
+	Dir string
+}
+
+func (b *LocalFSBackend) Put(key string, r io.Reader) (int64, error) {
+	dst, err := os.Create(filepath.Join(b.Dir, key))
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	written, err := io.Copy(dst, r)
+	if err != nil {
+		os.Remove(filepath.Join(b.Dir, key))
+		return 0, err
+	}
+	return written, nil
+}
+
+func (b *LocalFSBackend) Get(key string) (io.ReadCloser, StorageFileInfo, error) {
+	path := filepath.Join(b.Dir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, StorageFileInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, StorageFileInfo{}, err
+	}
+	return f, StorageFileInfo{Name: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *LocalFSBackend) Delete(key string) error {
+	return os.Remove(filepath.Join(b.Dir, key))
+}
+
+func (b *LocalFSBackend) List() ([]StorageFileInfo, error) {
+	entries, err := os.ReadDir(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []StorageFileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, StorageFileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+func (b *LocalFSBackend) Exists(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(b.Dir, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// S3Backend stores files in an S3-compatible bucket, configurable via
+// S3_BUCKET, S3_REGION and (for MinIO and similar) S3_ENDPOINT.
+type S3Backend struct {
+	Bucket   string
+	Client   *s3.Client
+	Uploader *manager.Uploader
+}
+
+func newS3Backend() (StorageBackend, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET must be set when STORAGE_BACKEND=s3")
+	}
+
+	ctx := context.Background()
+	var opts []func(*config.LoadOptions) error
+	if region := os.Getenv("S3_REGION"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true // required by MinIO and most non-AWS endpoints
+		}
+	})
+
+	return &S3Backend{Bucket: bucket, Client: client, Uploader: manager.NewUploader(client)}, nil
+}
+
+// countingReader wraps an io.Reader to track how many bytes have passed
+// through it, so Put can report the uploaded size without buffering the
+// whole body just to measure it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (b *S3Backend) Put(key string, r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	_, err := b.Uploader.Upload(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+		Body:   cr,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cr.n, nil
+}
+
+func (b *S3Backend) Get(key string) (io.ReadCloser, StorageFileInfo, error) {
+	out, err := b.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, StorageFileInfo{}, err
+	}
+
+	info := StorageFileInfo{Name: key}
+	if out.ContentLength != nil {
+		info.Size = *out.ContentLength
+	}
+	if out.LastModified != nil {
+		info.ModTime = *out.LastModified
+	}
+	return out.Body, info, nil
+}
+
+func (b *S3Backend) Delete(key string) error {
+	_, err := b.Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (b *S3Backend) List() ([]StorageFileInfo, error) {
+	var files []StorageFileInfo
+	paginator := s3.NewListObjectsV2Paginator(b.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.Bucket),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			info := StorageFileInfo{Name: aws.ToString(obj.Key)}
+			if obj.Size != nil {
+				info.Size = *obj.Size
+			}
+			if obj.LastModified != nil {
+				info.ModTime = *obj.LastModified
+			}
+			files = append(files, info)
+		}
+	}
+	return files, nil
+}
+
+func (b *S3Backend) Exists(key string) (bool, error) {
+	_, err := b.Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
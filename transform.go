@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/gift"
+)
+
+// CacheDir holds rendered image variants, keyed by source file and
+// transform parameters, kept local regardless of the active StorageBackend.
+var CacheDir = filepath.Join(UploadDir, "cache")
+
+// MaxTransformDimension caps requested width/height to avoid decompression
+// bombs from a tiny source expanding into a huge canvas.
+const MaxTransformDimension = 4096
+
+// MaxSourcePixels caps the source image's own width*height before it's fully
+// decoded, so a small, highly-compressible file claiming an enormous canvas
+// (e.g. a solid-color PNG reported as 30000x30000) can't be decoded into
+// gigabytes of pixel data.
+const MaxSourcePixels = 64_000_000
+
+// errSourceTooLarge is returned by decodeImage when the source's declared
+// dimensions exceed MaxSourcePixels.
+var errSourceTooLarge = errors.New("source image dimensions exceed the decode limit")
+
+func ensureCacheDir() error {
+	return os.MkdirAll(CacheDir, 0755)
+}
+
+// isTransformRequest reports whether the query string carries any
+// recognized image transform parameter.
+func isTransformRequest(q url.Values) bool {
+	for _, key := range []string{"w", "h", "fit", "fmt", "q", "blur"} {
+		if q.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleImageVariant serves a resized/re-encoded variant of filename
+// according to the request's transform query parameters, caching the
+// result under CacheDir so repeat requests skip re-processing.
+func handleImageVariant(w http.ResponseWriter, r *http.Request, filename string) {
+	q := r.URL.Query()
+
+	width, err := parseTransformInt(q.Get("w"), 0)
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "w must be a positive integer")
+		return
+	}
+	height, err := parseTransformInt(q.Get("h"), 0)
+	if err != nil {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "h must be a positive integer")
+		return
+	}
+	if width > MaxTransformDimension {
+		width = MaxTransformDimension
+	}
+	if height > MaxTransformDimension {
+		height = MaxTransformDimension
+	}
+
+	quality, err := parseTransformInt(q.Get("q"), WebPQuality)
+	if err != nil || quality < 1 || quality > 100 {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "q must be between 1 and 100")
+		return
+	}
+	blur, err := strconv.ParseFloat(stringOr(q.Get("blur"), "0"), 64)
+	if err != nil || blur < 0 {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "blur must be a non-negative number")
+		return
+	}
+
+	fit := stringOr(q.Get("fit"), "contain")
+	if fit != "contain" && fit != "cover" {
+		sendErrorResponse(w, "Invalid parameter", http.StatusBadRequest, "fit must be 'contain' or 'cover'")
+		return
+	}
+
+	outExt := "." + stringOr(q.Get("fmt"), "")
+	if outExt == "." {
+		outExt = filepath.Ext(filename)
+	}
+	if !isImageFile(outExt) && outExt != ".webp" {
+		sendErrorResponse(w, "Unsupported format", http.StatusBadRequest, "fmt must be jpg, png, gif or webp")
+		return
+	}
+
+	cacheKey := transformCacheKey(filename, r.URL.RawQuery)
+	cachePath := filepath.Join(CacheDir, cacheKey+outExt)
+
+	if r.Header.Get("If-None-Match") == cacheKey {
+		w.Header().Set("ETag", cacheKey)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if cached, err := os.Open(cachePath); err == nil {
+		defer cached.Close()
+		info, err := cached.Stat()
+		var size int64
+		if err == nil {
+			size = info.Size()
+		}
+		w.Header().Set("ETag", cacheKey)
+		w.Header().Set("Content-Type", mimeTypeForExt(outExt))
+		io.Copy(w, cached)
+		recordDownload(http.StatusOK, size)
+		return
+	}
+
+	reader, _, err := backend.Get(filename)
+	if os.IsNotExist(err) {
+		recordDownload(http.StatusNotFound, 0)
+		sendErrorResponse(w, "File not found", http.StatusNotFound, fmt.Sprintf("File '%s' does not exist", filename))
+		return
+	}
+	if err != nil {
+		recordDownload(http.StatusInternalServerError, 0)
+		sendErrorResponse(w, "File access error", http.StatusInternalServerError, "Could not access file")
+		return
+	}
+	defer reader.Close()
+
+	src, err := decodeImage(reader, filepath.Ext(filename))
+	if errors.Is(err, errSourceTooLarge) {
+		sendErrorResponse(w, "Unsupported source", http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	if err != nil {
+		sendErrorResponse(w, "Unsupported source", http.StatusUnsupportedMediaType, "Source file is not a decodable image")
+		return
+	}
+
+	out := applyTransform(src, width, height, fit, blur)
+
+	if err := ensureCacheDir(); err != nil {
+		sendErrorResponse(w, "Cache error", http.StatusInternalServerError, "Could not prepare cache directory")
+		return
+	}
+
+	cacheFile, err := os.Create(cachePath)
+	if err != nil {
+		sendErrorResponse(w, "Cache error", http.StatusInternalServerError, "Could not write cache file")
+		return
+	}
+	defer cacheFile.Close()
+
+	if err := encodeImage(cacheFile, out, outExt, quality); err != nil {
+		sendErrorResponse(w, "Encode failed", http.StatusInternalServerError, "Could not encode variant: "+err.Error())
+		return
+	}
+
+	if _, err := cacheFile.Seek(0, io.SeekStart); err != nil {
+		sendErrorResponse(w, "Cache error", http.StatusInternalServerError, "Could not read back cache file")
+		return
+	}
+
+	w.Header().Set("ETag", cacheKey)
+	w.Header().Set("Content-Type", mimeTypeForExt(outExt))
+	io.Copy(w, cacheFile)
+
+	var servedSize int64
+	if info, err := cacheFile.Stat(); err == nil {
+		servedSize = info.Size()
+	}
+	recordDownload(http.StatusOK, servedSize)
+	fmt.Printf("Served variant: %s?%s -> %s\n", filename, r.URL.RawQuery, cacheKey+outExt)
+}
+
+// applyTransform resizes src per fit ("contain" keeps aspect ratio inside
+// w×h, "cover" fills and crops) and optionally applies a Gaussian blur.
+func applyTransform(src image.Image, width, height int, fit string, blur float64) image.Image {
+	var filters []gift.Filter
+	if width > 0 || height > 0 {
+		if fit == "cover" {
+			filters = append(filters, gift.ResizeToFill(width, height, gift.LanczosResampling, gift.CenterAnchor))
+		} else {
+			filters = append(filters, gift.ResizeToFit(width, height, gift.LanczosResampling))
+		}
+	}
+	if blur > 0 {
+		filters = append(filters, gift.GaussianBlur(float32(blur)))
+	}
+	if len(filters) == 0 {
+		return src
+	}
+
+	g := gift.New(filters...)
+	dst := image.NewRGBA(g.Bounds(src.Bounds()))
+	g.Draw(dst, src)
+	return dst
+}
+
+// decodeImage decodes r as ext, first checking the source's declared
+// dimensions via DecodeConfig so an image bomb is rejected before the full
+// pixel buffer is ever allocated.
+func decodeImage(r io.Reader, ext string) (image.Image, error) {
+	var header bytes.Buffer
+	tee := io.TeeReader(r, &header)
+
+	var cfg image.Config
+	var err error
+	switch ext {
+	case ".jpg", ".jpeg":
+		cfg, err = jpeg.DecodeConfig(tee)
+	case ".png":
+		cfg, err = png.DecodeConfig(tee)
+	case ".gif":
+		cfg, err = gif.DecodeConfig(tee)
+	case ".webp":
+		cfg, err = webp.DecodeConfig(tee)
+	default:
+		return nil, fmt.Errorf("unsupported source format: %s", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxSourcePixels {
+		return nil, errSourceTooLarge
+	}
+
+	full := io.MultiReader(&header, r)
+	switch ext {
+	case ".jpg", ".jpeg":
+		return jpeg.Decode(full)
+	case ".png":
+		return png.Decode(full)
+	case ".gif":
+		return gif.Decode(full)
+	case ".webp":
+		return webp.Decode(full)
+	default:
+		return nil, fmt.Errorf("unsupported source format: %s", ext)
+	}
+}
+
+func encodeImage(w io.Writer, img image.Image, ext string, quality int) error {
+	switch ext {
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case ".png":
+		return png.Encode(w, img)
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	case ".webp":
+		return webp.Encode(w, img, &webp.Options{Lossless: false, Quality: float32(quality)})
+	default:
+		return fmt.Errorf("unsupported output format: %s", ext)
+	}
+}
+
+func transformCacheKey(filename, rawQuery string) string {
+	sum := sha256.Sum256([]byte(filename + "?" + rawQuery))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseTransformInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid integer: %s", value)
+	}
+	return n, nil
+}
+
+func stringOr(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// TusDir holds in-progress resumable uploads, kept apart from finished
+// files so they never show up in /files or /uploads/.
+var TusDir = filepath.Join(UploadDir, ".tus")
+
+// TmpDir holds in-progress streaming uploads while they're being hashed,
+// kept apart from finished files for the same reason as TusDir: a partial
+// upload must never show up in /files or be servable from /uploads/.
+var TmpDir = filepath.Join(UploadDir, ".tmp")
+
+func ensureTmpDir() error {
+	return os.MkdirAll(TmpDir, 0755)
+}
+
+const TusResumableVersion = "1.0.0"
+
+// UploadInfo is the on-disk sidecar tracking a resumable upload's progress.
+type UploadInfo struct {
+	ID         string `json:"id"`
+	Length     int64  `json:"length"`
+	Offset     int64  `json:"offset"`
+	Filename   string `json:"filename"`
+	Ext        string `json:"ext"`
+	DeleteKey  string `json:"delete_key"`
+	ExpiryUnix int64  `json:"expiry_unix,omitempty"`
+}
+
+func ensureTusDir() error {
+	return os.MkdirAll(TusDir, 0755)
+}
+
+func tusDataPath(id string) string {
+	return filepath.Join(TusDir, id+".bin")
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(TusDir, id+".info")
+}
+
+func readTusInfo(id string) (*UploadInfo, error) {
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var info UploadInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func writeTusInfo(info *UploadInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tusInfoPath(info.ID), data, 0644)
+}
+
+// Handle file uploads by streaming directly to disk instead of buffering
+// the whole multipart form in memory.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use POST method")
+		return
+	}
+
+	maxRequestSize := MaxFileSize + (10 << 20) // Add 10MB for multipart form overhead
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxRequestSize))
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		sendErrorResponse(w, "Invalid form", http.StatusBadRequest, "Form data invalid: "+err.Error())
+		return
+	}
+
+	var part *multipart.Part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sendErrorResponse(w, "Invalid form", http.StatusBadRequest, "Form data invalid: "+err.Error())
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			break
+		}
+		p.Close()
+	}
+	if part == nil {
+		sendErrorResponse(w, "No file provided", http.StatusBadRequest, "No file found in form data")
+		return
+	}
+	defer part.Close()
+
+	originalExt := strings.ToLower(filepath.Ext(part.FileName()))
+	id := uuid.New().String()
+
+	if err := ensureTmpDir(); err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not prepare upload storage")
+		return
+	}
+
+	tmpPath := filepath.Join(TmpDir, id)
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not create temp file")
+		return
+	}
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hasher), part)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		if strings.Contains(err.Error(), "http: request body too large") {
+			sendErrorResponse(w, "File too large", http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("File size exceeds %d MB limit", MaxFileSize/(1<<20)))
+		} else {
+			sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not write file: "+err.Error())
+		}
+		return
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	defer os.Remove(tmpPath)
+
+	var filename string
+	var converted bool
+	var finalSize int64
+
+	var originalSize int64
+	if info, err := os.Stat(tmpPath); err == nil {
+		originalSize = info.Size()
+	}
+
+	if ConvertToWebP && isImageFile(originalExt) {
+		src, err := os.Open(tmpPath)
+		if err == nil {
+			var buf bytes.Buffer
+			convertedSize, convErr := convertToWebP(src, &buf, originalExt)
+			src.Close()
+			if convErr != nil {
+				fmt.Printf("WebP conversion failed for %s: %v, saving original\n", part.FileName(), convErr)
+			} else {
+				webpFilename := id + ".webp"
+				if _, err := backend.Put(webpFilename, &buf); err != nil {
+					recordUpload(http.StatusInternalServerError, 0)
+					sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not store converted file")
+					return
+				}
+				filename = webpFilename
+				finalSize = convertedSize
+				converted = true
+				recordWebPConversion(originalSize, convertedSize)
+			}
+		}
+	}
+
+	if filename == "" {
+		src, err := os.Open(tmpPath)
+		if err != nil {
+			recordUpload(http.StatusInternalServerError, 0)
+			sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not reopen temp file")
+			return
+		}
+		filename = id + originalExt
+		finalSize, err = backend.Put(filename, src)
+		src.Close()
+		if err != nil {
+			recordUpload(http.StatusInternalServerError, 0)
+			sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not finalize file")
+			return
+		}
+	}
+
+	if finalSize == 0 {
+		recordUpload(http.StatusInternalServerError, 0)
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not save file")
+		return
+	}
+
+	expiry, err := parseExpiryHeader(r.Header.Get("Upload-Expiry"))
+	if err != nil {
+		recordUpload(http.StatusBadRequest, 0)
+		sendErrorResponse(w, "Invalid Upload-Expiry", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	deleteKey, err := generateDeleteKey()
+	if err != nil {
+		recordUpload(http.StatusInternalServerError, 0)
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not generate delete key")
+		return
+	}
+
+	meta := &FileMetadata{
+		Filename:         filename,
+		OriginalFilename: part.FileName(),
+		DeleteKey:        deleteKey,
+		SHA256Sum:        sum,
+		Mimetype:         mimeTypeForExt(filepath.Ext(filename)),
+		Size:             finalSize,
+		ExpiryUnix:       expiry,
+	}
+	if err := writeMetadata(meta); err != nil {
+		recordUpload(http.StatusInternalServerError, 0)
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not write metadata")
+		return
+	}
+
+	url := fmt.Sprintf("%s/uploads/%s", BaseURL, filename)
+	response := UploadResponse{
+		URL:         url,
+		Filename:    filename,
+		OriginalExt: originalExt,
+		Size:        finalSize,
+		Converted:   converted,
+		SHA256:      sum,
+		DeleteKey:   deleteKey,
+		Message:     "File uploaded successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+
+	recordUpload(http.StatusCreated, finalSize)
+	if converted {
+		fmt.Printf("Uploaded & converted: %s -> %s (%d bytes, WebP)\n", part.FileName(), filename, finalSize)
+	} else {
+		fmt.Printf("Uploaded: %s -> %s (%d bytes)\n", part.FileName(), filename, finalSize)
+	}
+}
+
+// handleTusOrList dispatches GET /files to the existing file listing and
+// POST /files to tus.io resumable upload creation.
+func handleTusOrList(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handleTusCreate(w, r)
+		return
+	}
+	handleFileList(w, r)
+}
+
+// Handle tus.io upload creation: POST /files with an Upload-Length header
+// reserves a resumable upload and returns its location.
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use POST method")
+		return
+	}
+	if !isAuthorized(r) {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized, "Invalid or missing authorization token")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		sendErrorResponse(w, "Invalid Upload-Length", http.StatusBadRequest, "Upload-Length header must be a positive integer")
+		return
+	}
+	if length > MaxFileSize {
+		sendErrorResponse(w, "File too large", http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload-Length exceeds %d MB limit", MaxFileSize/(1<<20)))
+		return
+	}
+
+	expiry, err := parseExpiryHeader(r.Header.Get("Upload-Expiry"))
+	if err != nil {
+		sendErrorResponse(w, "Invalid Upload-Expiry", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	deleteKey, err := generateDeleteKey()
+	if err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not generate delete key")
+		return
+	}
+
+	filename := r.Header.Get("Upload-Filename")
+	ext := strings.ToLower(filepath.Ext(filename))
+	id := uuid.New().String()
+
+	if err := ensureTusDir(); err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not prepare upload storage")
+		return
+	}
+
+	f, err := os.Create(tusDataPath(id))
+	if err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not reserve upload")
+		return
+	}
+	f.Close()
+
+	info := &UploadInfo{ID: id, Length: length, Offset: 0, Filename: filename, Ext: ext, DeleteKey: deleteKey, ExpiryUnix: expiry}
+	if err := writeTusInfo(info); err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not persist upload info")
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusResumableVersion)
+	w.Header().Set("Location", fmt.Sprintf("%s/files/%s", BaseURL, id))
+	w.Header().Set("Upload-Delete-Key", deleteKey)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handle tus.io offset queries: HEAD /files/{id}.
+func handleTusHead(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := readTusInfo(id)
+	if err != nil {
+		sendErrorResponse(w, "Upload not found", http.StatusNotFound, "No resumable upload with that id")
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusResumableVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handle tus.io resumable chunks: PATCH /files/{id}.
+func handleTusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if !isAuthorized(r) {
+		sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized, "Invalid or missing authorization token")
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		sendErrorResponse(w, "Invalid Content-Type", http.StatusBadRequest, "Expected application/offset+octet-stream")
+		return
+	}
+
+	info, err := readTusInfo(id)
+	if err != nil {
+		sendErrorResponse(w, "Upload not found", http.StatusNotFound, "No resumable upload with that id")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != info.Offset {
+		sendErrorResponse(w, "Offset mismatch", http.StatusConflict, "Upload-Offset does not match current upload state")
+		return
+	}
+
+	f, err := os.OpenFile(tusDataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not open upload for writing")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not seek upload")
+		return
+	}
+
+	written, err := io.Copy(f, http.MaxBytesReader(w, r.Body, info.Length-offset))
+	if err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not write chunk: "+err.Error())
+		return
+	}
+
+	info.Offset += written
+	if err := writeTusInfo(info); err != nil {
+		sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not persist upload progress")
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusResumableVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+
+	if info.Offset >= info.Length {
+		if err := finalizeTusUpload(info); err != nil {
+			sendErrorResponse(w, "Save failed", http.StatusInternalServerError, "Could not finalize upload: "+err.Error())
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeTusUpload stores a completed resumable upload through the active
+// StorageBackend, converting it to WebP first when applicable, writes its metadata sidecar,
+// and removes its tus state.
+func finalizeTusUpload(info *UploadInfo) error {
+	defer os.Remove(tusInfoPath(info.ID))
+
+	src := tusDataPath(info.ID)
+	defer os.Remove(src)
+
+	sum, _, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+
+	var filename string
+	var finalSize int64
+
+	var originalSize int64
+	if st, err := os.Stat(src); err == nil {
+		originalSize = st.Size()
+	}
+
+	if ConvertToWebP && isImageFile(info.Ext) {
+		f, err := os.Open(src)
+		if err == nil {
+			var buf bytes.Buffer
+			convertedSize, convErr := convertToWebP(f, &buf, info.Ext)
+			f.Close()
+			if convErr == nil {
+				webpFilename := info.ID + ".webp"
+				if _, err := backend.Put(webpFilename, &buf); err == nil {
+					filename = webpFilename
+					finalSize = convertedSize
+					recordWebPConversion(originalSize, convertedSize)
+				}
+			}
+		}
+	}
+
+	if filename == "" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		filename = info.ID + info.Ext
+		written, err := backend.Put(filename, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		finalSize = written
+	}
+
+	meta := &FileMetadata{
+		Filename:         filename,
+		OriginalFilename: info.Filename,
+		DeleteKey:        info.DeleteKey,
+		SHA256Sum:        sum,
+		Mimetype:         mimeTypeForExt(filepath.Ext(filename)),
+		Size:             finalSize,
+		ExpiryUnix:       info.ExpiryUnix,
+	}
+	if err := writeMetadata(meta); err != nil {
+		return err
+	}
+
+	recordUpload(http.StatusNoContent, finalSize)
+	return nil
+}
+
+// hashFile returns the SHA-256 sum and size of the file at path.
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// Routes /files and /files/{id} to creation, offset queries or chunk
+// appends depending on method, per the tus.io resumable upload protocol.
+func handleTusFiles(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+
+	if id == "" || r.URL.Path == "/files" {
+		handleTusCreate(w, r)
+		return
+	}
+
+	if strings.Contains(id, "..") || strings.Contains(id, "/") {
+		sendErrorResponse(w, "Invalid id", http.StatusBadRequest, "Upload id contains invalid characters")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		handleTusHead(w, r, id)
+	case http.MethodPatch:
+		handleTusPatch(w, r, id)
+	default:
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, "Use HEAD or PATCH")
+	}
+}